@@ -17,10 +17,16 @@ limitations under the License.
 package validation
 
 import (
+	"fmt"
+	"hash"
+	"hash/fnv"
 	"reflect"
+	"sort"
+	"time"
 
 	"k8s.io/apiserver/pkg/cel/common"
 	celopenapi "k8s.io/apiserver/pkg/cel/openapi"
+	"k8s.io/kube-openapi/pkg/validation/errors"
 	"k8s.io/kube-openapi/pkg/validation/spec"
 	"k8s.io/kube-openapi/pkg/validation/strfmt"
 	"k8s.io/kube-openapi/pkg/validation/validate"
@@ -40,8 +46,25 @@ type schemaArgs struct {
 // ValidateUpdate function which allows ratcheting
 type RatchetingSchemaValidator struct {
 	schemaArgs
+
+	// ratchetAtomicLists opts into correlating x-kubernetes-list-type: atomic
+	// lists as a single unit (see WithAtomicListRatcheting).
+	ratchetAtomicLists bool
+
+	// policy decides whether an individual validation error should be
+	// ratcheted. Defaults to DeepEqualRatchetingPolicy.
+	policy RatchetingPolicy
+
+	// contentHasher, if set, lets CachedDeepEqual short-circuit its
+	// comparison using precomputed content hashes instead of walking the
+	// value. See WithContentHasher.
+	contentHasher ContentHasher
 }
 
+// ContentHasher computes a content hash for a decoded value, such that equal
+// values always hash the same, for use with WithContentHasher.
+type ContentHasher func(v interface{}) uint64
+
 func NewRatchetingSchemaValidator(schema *spec.Schema, rootSchema interface{}, root string, formats strfmt.Registry, options ...validate.Option) *RatchetingSchemaValidator {
 	return &RatchetingSchemaValidator{
 		schemaArgs: schemaArgs{
@@ -51,16 +74,93 @@ func NewRatchetingSchemaValidator(schema *spec.Schema, rootSchema interface{}, r
 			knownFormats: formats,
 			options:      options,
 		},
+		policy: DeepEqualRatchetingPolicy{},
 	}
 }
 
+// WithPolicy sets the RatchetingPolicy used to decide whether individual
+// validation errors should be ratcheted, in place of the default
+// DeepEqualRatchetingPolicy. It returns the receiver so it can be chained
+// onto NewRatchetingSchemaValidator.
+func (r *RatchetingSchemaValidator) WithPolicy(policy RatchetingPolicy) *RatchetingSchemaValidator {
+	r.policy = policy
+	return r
+}
+
+// WithAtomicListRatcheting opts into ratcheting x-kubernetes-list-type: atomic
+// lists as a whole: if the entire list is reflect.DeepEqual to its old value,
+// errors found anywhere underneath it are eligible for ratcheting even though
+// atomic lists are never correlated item-by-item. This is useful for picking
+// up ratcheting of errors introduced by tightening a schema underneath an
+// atomic list that operators otherwise have no way to migrate away from
+// gradually. It returns the receiver so it can be chained onto
+// NewRatchetingSchemaValidator. Off by default, since it is a relaxation of
+// the existing behavior that operators must opt into deliberately.
+func (r *RatchetingSchemaValidator) WithAtomicListRatcheting() *RatchetingSchemaValidator {
+	r.ratchetAtomicLists = true
+	return r
+}
+
+// WithContentHasher configures CachedDeepEqual to short-circuit its
+// comparison using hasher instead of walking the value with
+// reflect.DeepEqual. The hashes are trusted unconditionally, so hasher should
+// only be supplied when Value and OldValue originate from the same decoder
+// (e.g. both CBOR, or both unstructured JSON) so that their hashes are
+// directly comparable. This turns what is otherwise an O(N) walk of a
+// large array/object into an O(1) hash comparison per node. It returns the
+// receiver so it can be chained onto NewRatchetingSchemaValidator. If never
+// called, CachedDeepEqual falls back to reflect.DeepEqual as before.
+func (r *RatchetingSchemaValidator) WithContentHasher(hasher ContentHasher) *RatchetingSchemaValidator {
+	r.contentHasher = hasher
+	return r
+}
+
 func (r *RatchetingSchemaValidator) Validate(new interface{}) *validate.Result {
 	sv := validate.NewSchemaValidator(r.schema, r.root, r.path, r.knownFormats, r.options...)
 	return sv.Validate(new)
 }
 
-func (r *RatchetingSchemaValidator) ValidateUpdate(new, old interface{}) *validate.Result {
-	return newRatchetingValueValidator(NewCorrelatedObject(new, old, r.schema), r.schemaArgs).Validate(new)
+func (r *RatchetingSchemaValidator) ValidateUpdate(new, old interface{}) *Result {
+	var opts []CorrelatedObjectOption
+	if r.ratchetAtomicLists {
+		opts = append(opts, WithAtomicListRatcheting())
+	}
+	if r.contentHasher != nil {
+		opts = append(opts, WithContentHasher(r.contentHasher))
+	}
+	return r.ValidateUpdateWithCorrelation(new, old, NewCorrelatedObject(new, old, r.schema, opts...))
+}
+
+// ValidateUpdateWithCorrelation behaves exactly like ValidateUpdate, except
+// that it validates against a caller-provided CorrelatedObject instead of
+// building a fresh one for new/old. This lets callers that run more than one
+// validation pass over the same update — for example schema validation
+// followed by CEL validation, both of which need to correlate the same
+// old/new pair — share the memoized CachedDeepEqual, mapList and setIndex
+// state accumulated while traversing the tree, rather than recomputing it
+// once per pass. The caller is responsible for ensuring correlation was
+// built from the same new/old values being validated here.
+func (r *RatchetingSchemaValidator) ValidateUpdateWithCorrelation(new, old interface{}, correlation *CorrelatedObject) *Result {
+	start := time.Now()
+	audit := &[]RatchetedError{}
+	res := newRatchetingValueValidator(correlation, r.schemaArgs, r.policy, audit).Validate(new)
+	Metrics.ObserveTraversalTime(time.Since(start).Seconds())
+	return &Result{Result: res, RatchetedErrors: *audit}
+}
+
+// WithRatchetingCorrelation returns a kube-openapi validate.Option that makes
+// a directly-constructed validate.SchemaValidator ratchet against correlation
+// using policy. It is for callers that build their own SchemaValidator via
+// raw validate.Option plumbing instead of going through
+// RatchetingSchemaValidator — for example, a second validation pass (such as
+// CEL validation) that needs to share the same CorrelatedObject tree as an
+// earlier pass so memoized CachedDeepEqual/mapList/setIndex state isn't
+// recomputed. The returned option must be passed to a validate.SchemaValidator
+// validating correlation.Value against correlation.Schema. Only errors found
+// under the properties and items of correlation.Value are ratcheted; errors
+// that the SchemaValidator reports on correlation.Value itself are not.
+func WithRatchetingCorrelation(correlation *CorrelatedObject, policy RatchetingPolicy) validate.Option {
+	return newRatchetingValueValidator(correlation, schemaArgs{}, policy, nil).getValidateOption()
 }
 
 // ratchetingValueValidator represents an invocation of SchemaValidator.ValidateUpdate
@@ -81,6 +181,16 @@ type ratchetingValueValidator struct {
 	// that is created during a call to Validate.
 	schemaArgs
 	correlation *CorrelatedObject
+
+	// policy decides whether an error found while validating this node
+	// should be ratcheted. Carried down to every child validator so the
+	// same policy applies throughout a single ValidateUpdate call.
+	policy RatchetingPolicy
+
+	// audit accumulates a RatchetedError for every error ratcheted anywhere
+	// in the tree during a single top-level ValidateUpdate(WithCorrelation)
+	// call. Shared by pointer across every node in the tree.
+	audit *[]RatchetedError
 }
 
 type CorrelatedObject struct {
@@ -100,6 +210,24 @@ type CorrelatedObject struct {
 	// Cached map representation of a map-type list, or nil if not map-type list
 	mapList common.MapList
 
+	// Cached lookup index from a canonical content hash of an OldValue list
+	// element to the old elements sharing that hash, used to correlate
+	// x-kubernetes-list-type: set elements by identity rather than by
+	// position. Lazily built, parallel to mapList, and only ever populated
+	// for set-type lists.
+	setIndex map[uint64][]interface{}
+
+	// Cached result of reflect.DeepEqual(OldValue, Value) for an atomic
+	// list, or nil if not yet computed / not an atomic list being ratcheted.
+	// Avoids recomputing the same whole-list comparison once per index in
+	// correlateOldValueForChildAtNewIndex.
+	atomicListEqual *bool
+
+	// Cached content hashes of Value and OldValue, populated lazily by
+	// CachedDeepEqual the first time it needs them. Only used when opts.hasher
+	// is set; nil otherwise.
+	valueHash, oldValueHash *uint64
+
 	// Children spawned by a call to `Validate` on this object
 	// key is either a string or an index, depending upon whether `value` is
 	// a map or a list, respectively.
@@ -111,20 +239,73 @@ type CorrelatedObject struct {
 	// It should be expected to have an entry for either all of the children, or
 	// none of them.
 	children map[interface{}]*CorrelatedObject
+
+	// opts carries cross-cutting, opt-in settings shared by every node in
+	// this object's tree. It is a pointer so that children constructed
+	// during traversal (see Key/Index) see the same settings as their
+	// parent without needing to thread options through every call.
+	opts *correlationOptions
+
+	// parent is the CorrelatedObject this node was spawned from via Key or
+	// Index, or nil for the root. Used by policies such as
+	// AncestorCorrelatedRatchetingPolicy that need to walk up the tree.
+	parent *CorrelatedObject
+}
+
+// CorrelatedObjectOption configures the tree rooted at a CorrelatedObject
+// returned by NewCorrelatedObject.
+type CorrelatedObjectOption func(*correlationOptions)
+
+// correlationOptions holds the opt-in settings for a CorrelatedObject tree.
+type correlationOptions struct {
+	// ratchetAtomicLists enables correlating x-kubernetes-list-type: atomic
+	// lists as a whole when they are unchanged. See WithAtomicListRatcheting.
+	ratchetAtomicLists bool
+
+	// hasher, if set, lets CachedDeepEqual short-circuit using precomputed
+	// content hashes instead of walking the value. See WithContentHasher.
+	hasher ContentHasher
 }
 
-func NewCorrelatedObject(new, old interface{}, schema *spec.Schema) *CorrelatedObject {
+// WithAtomicListRatcheting opts a CorrelatedObject tree into correlating
+// x-kubernetes-list-type: atomic lists as a single unit when the old and new
+// lists are wholly reflect.DeepEqual, instead of never correlating them.
+func WithAtomicListRatcheting() CorrelatedObjectOption {
+	return func(o *correlationOptions) {
+		o.ratchetAtomicLists = true
+	}
+}
+
+// WithContentHasher opts a CorrelatedObject tree into short-circuiting
+// CachedDeepEqual with hasher instead of walking the value with
+// reflect.DeepEqual. hasher should only be supplied when Value and OldValue
+// throughout the tree originate from the same decoder, so that their hashes
+// are directly comparable.
+func WithContentHasher(hasher ContentHasher) CorrelatedObjectOption {
+	return func(o *correlationOptions) {
+		o.hasher = hasher
+	}
+}
+
+func NewCorrelatedObject(new, old interface{}, schema *spec.Schema, opts ...CorrelatedObjectOption) *CorrelatedObject {
+	o := &correlationOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	return &CorrelatedObject{
 		OldValue: old,
 		Value:    new,
 		Schema:   schema,
+		opts:     o,
 	}
 }
 
-func newRatchetingValueValidator(correlation *CorrelatedObject, args schemaArgs) *ratchetingValueValidator {
+func newRatchetingValueValidator(correlation *CorrelatedObject, args schemaArgs, policy RatchetingPolicy, audit *[]RatchetedError) *ratchetingValueValidator {
 	return &ratchetingValueValidator{
 		schemaArgs:  args,
 		correlation: correlation,
+		policy:      policy,
+		audit:       audit,
 	}
 }
 
@@ -169,14 +350,49 @@ func (r *ratchetingValueValidator) Validate(new interface{}) *validate.Result {
 		return res
 	}
 
-	// Current ratcheting rule is to ratchet errors if DeepEqual(old, new) is true.
-	if r.correlation.CachedDeepEqual() {
-		newRes := &validate.Result{}
-		newRes.MergeAsWarnings(res)
-		return newRes
+	newRes := &validate.Result{}
+	newRes.AddWarnings(res.Warnings...)
+	for _, err := range res.Errors {
+		codedErr, ok := err.(errors.Error)
+		if !ok {
+			// Errors that don't carry a rule code (e.g. CEL validation errors
+			// surfaced as plain errors) can't be classified by Code(), so no
+			// RatchetingPolicy can decide on them. Fall back to the original,
+			// pre-pluggable-policy behavior instead of always treating them as
+			// hard failures: ratchet as a warning iff the value it was found
+			// on is unchanged from old.
+			if r.correlation.CachedDeepEqual() {
+				Metrics.ObserveRatchetedError("")
+				ratcheted := RatchetedError{Path: r.path, Warning: err}
+				newRes.AddWarnings(err)
+				if r.audit != nil {
+					*r.audit = append(*r.audit, ratcheted)
+				}
+				continue
+			}
+			newRes.AddErrors(err)
+			continue
+		}
+
+		if ratchet, asWarning := r.policy.ShouldRatchet(r.correlation, codedErr); ratchet {
+			rule := ruleNameForError(codedErr)
+
+			ratcheted := RatchetedError{Path: r.path, Rule: rule}
+			if asWarning {
+				Metrics.ObserveRatchetedError(rule)
+				newRes.AddWarnings(err)
+				ratcheted.Warning = err
+			}
+			if r.audit != nil {
+				*r.audit = append(*r.audit, ratcheted)
+			}
+			continue
+		}
+
+		newRes.AddErrors(err)
 	}
 
-	return res
+	return newRes
 }
 
 // SubPropertyValidator overrides the standard validator constructor for sub-properties by
@@ -198,7 +414,7 @@ func (r *ratchetingValueValidator) SubPropertyValidator(field string, schema *sp
 		path:         root,
 		knownFormats: formats,
 		options:      options,
-	})
+	}, r.policy, r.audit)
 }
 
 // SubIndexValidator overrides the standard validator constructor for sub-indicies by
@@ -220,7 +436,7 @@ func (r *ratchetingValueValidator) SubIndexValidator(index int, schema *spec.Sch
 		path:         root,
 		knownFormats: formats,
 		options:      options,
-	})
+	}, r.policy, r.audit)
 }
 
 // If oldValue is not a list, returns nil
@@ -257,14 +473,30 @@ func (r *CorrelatedObject) correlateOldValueForChildAtNewIndex(index int) any {
 		return oldList.Get(currentElement)
 
 	case "set":
-		// Are sets correlatable? Only if the old value equals the current value.
-		// We might be able to support this, but do not currently see a lot
-		// of value
-		// (would allow you to add/remove items from sets with ratcheting but not change them)
-		return nil
+		// Sets have no positional identity, so correlate each new element to
+		// the old element with the same content hash, if any. This allows
+		// ratcheting of unchanged elements even if the set was reordered, or
+		// had other elements added/removed.
+		return r.correlateSetElement(oldAsList, asList[index])
 	case "atomic":
-		// Atomic lists are not correlatable by item
-		// Ratcheting is not available on a per-index basis
+		// Atomic lists are not correlatable item-by-item: any change to one
+		// element is a change to the whole list. However, if the caller has
+		// opted in via WithAtomicListRatcheting and the two lists are wholly
+		// unchanged, correlate index-for-index so that pre-existing errors
+		// elsewhere in the list (e.g. introduced by tightening the schema)
+		// remain ratchetable. The DeepEqual check is cached, mirroring the
+		// "map" case's r.mapList above, since this branch is otherwise
+		// re-evaluated once per index and would make ratcheting an N-element
+		// atomic list O(N^2).
+		if r.opts != nil && r.opts.ratchetAtomicLists {
+			if r.atomicListEqual == nil {
+				eq := reflect.DeepEqual(r.OldValue, r.Value)
+				r.atomicListEqual = &eq
+			}
+			if *r.atomicListEqual {
+				return oldAsList[index]
+			}
+		}
 		return nil
 	default:
 		// Correlate by-index by default.
@@ -278,6 +510,74 @@ func (r *CorrelatedObject) correlateOldValueForChildAtNewIndex(index int) any {
 	}
 }
 
+// correlateSetElement looks up the old element correlated to currentElement
+// in a lazily built index from content hash to old elements sharing that
+// hash, building the index from oldAsList on first use and caching it on the
+// receiver alongside mapList. Returns nil if no old element with equal
+// content can be found.
+//
+// A matched old element is removed from the index once it has been returned,
+// so that each old element can be correlated to at most one new element.
+// Without this, a new list containing a duplicate of an old element (while
+// some other old element was dropped) would have every duplicate correlate
+// to the same single old element, making the new list appear unchanged when
+// it is not: e.g. old [A, B] -> new [A, A] would otherwise correlate both
+// A's in new to the one old A, losing track of B having been replaced.
+func (r *CorrelatedObject) correlateSetElement(oldAsList []interface{}, currentElement interface{}) interface{} {
+	if r.setIndex == nil {
+		r.setIndex = make(map[uint64][]interface{}, len(oldAsList))
+		for _, old := range oldAsList {
+			h := hashListElement(old)
+			r.setIndex[h] = append(r.setIndex[h], old)
+		}
+	}
+
+	h := hashListElement(currentElement)
+	bucket := r.setIndex[h]
+	for i, candidate := range bucket {
+		if reflect.DeepEqual(candidate, currentElement) {
+			r.setIndex[h] = append(bucket[:i], bucket[i+1:]...)
+			return candidate
+		}
+	}
+	return nil
+}
+
+// hashListElement computes a canonical content hash for a decoded JSON/YAML
+// value (nil, bool, float64, string, []interface{} or map[string]interface{}),
+// suitable for bucketing set-type list elements by identity. Map keys are
+// sorted so that key order, which carries no meaning for a decoded map,
+// cannot affect the result. Collisions are resolved by the caller via
+// reflect.DeepEqual.
+func hashListElement(v interface{}) uint64 {
+	h := fnv.New64a()
+	writeHashableValue(h, v)
+	return h.Sum64()
+}
+
+func writeHashableValue(h hash.Hash64, v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			h.Write([]byte{0}) // delimiter to avoid key/value concatenation collisions
+			h.Write([]byte(k))
+			writeHashableValue(h, t[k])
+		}
+	case []interface{}:
+		for _, e := range t {
+			h.Write([]byte{1})
+			writeHashableValue(h, e)
+		}
+	default:
+		fmt.Fprintf(h, "%T:%v", t, t)
+	}
+}
+
 // CachedDeepEqual is equivalent to reflect.DeepEqual, but caches the
 // results in the tree of ratchetInvocationScratch objects on the way:
 //
@@ -302,6 +602,22 @@ func (r *CorrelatedObject) CachedDeepEqual() (res bool) {
 		return false
 	}
 
+	// If a content hasher was configured, trust it completely instead of
+	// walking the value: this is what turns an O(N) DeepEqual of a large
+	// sub-tree into an O(1) comparison per node. Hashes are computed lazily,
+	// once per node, and cached alongside comparisonResult.
+	if r.opts != nil && r.opts.hasher != nil {
+		if r.valueHash == nil {
+			h := r.opts.hasher(r.Value)
+			r.valueHash = &h
+		}
+		if r.oldValueHash == nil {
+			h := r.opts.hasher(r.OldValue)
+			r.oldValueHash = &h
+		}
+		return *r.valueHash == *r.oldValueHash
+	}
+
 	oldAsArray, oldIsArray := r.OldValue.([]interface{})
 	newAsArray, newIsArray := r.Value.([]interface{})
 
@@ -319,11 +635,12 @@ func (r *CorrelatedObject) CachedDeepEqual() (res bool) {
 			return false
 		}
 
-		// Correctly considers map-type lists due to fact that index here
-		// is only used for numbering. The correlation is stored in the
-		// childInvocation itself
-		//
-		// NOTE: This does not consider sets, since we don't correlate them.
+		// Correctly considers map-type and set-type lists due to fact that
+		// index here is only used for numbering: the correlation itself,
+		// however it was found, is stored in the child. For a set-type
+		// list, a child missing from r.children (handled above) already
+		// means some new element had no old counterpart, so order-independent
+		// equality of equal-length lists falls out of this loop for free.
 		for i := range newAsArray {
 			// Query for child
 			child, ok := r.children[i]
@@ -376,6 +693,16 @@ func (r *CorrelatedObject) CachedDeepEqual() (res bool) {
 	return reflect.DeepEqual(r.OldValue, r.Value)
 }
 
+// rawDeepEqual reports whether Value and OldValue are reflect.DeepEqual,
+// without relying on any cached per-child correlation state. Unlike
+// CachedDeepEqual, it does not return false merely because some child of an
+// array/map node wasn't explored during validation, which makes it safe to
+// call on ancestors that may not have been fully traversed. See
+// AncestorCorrelatedRatchetingPolicy for why that distinction matters.
+func (r *CorrelatedObject) rawDeepEqual() bool {
+	return reflect.DeepEqual(r.Value, r.OldValue)
+}
+
 var _ validate.ValueValidator = (&ratchetingValueValidator{})
 
 func (f ratchetingValueValidator) SetPath(path string) {
@@ -425,6 +752,8 @@ func (l *CorrelatedObject) Key(field string) *CorrelatedObject {
 	}
 
 	res := NewCorrelatedObject(newValueForField, oldValueForField, propertySchema)
+	res.opts = l.opts
+	res.parent = l
 	l.children[field] = res
 	return res
 }
@@ -461,6 +790,8 @@ func (l *CorrelatedObject) Index(i int) *CorrelatedObject {
 	}
 
 	res := NewCorrelatedObject(asList[i], oldValueForIndex, itemSchema)
+	res.opts = l.opts
+	res.parent = l
 	l.children[i] = res
 	return res
 }
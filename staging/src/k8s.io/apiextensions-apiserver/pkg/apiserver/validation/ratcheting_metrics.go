@@ -0,0 +1,89 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+)
+
+// Metrics instruments ratcheting decisions made by RatchetingSchemaValidator,
+// following the same package-level, legacyregistry-backed pattern as the
+// rest of apiextensions-apiserver's validation metrics.
+var Metrics = newRatchetingMetrics()
+
+type ratchetingMetrics struct {
+	demotedErrors *metrics.CounterVec
+	traversalTime *metrics.Histogram
+}
+
+func newRatchetingMetrics() *ratchetingMetrics {
+	m := &ratchetingMetrics{
+		demotedErrors: metrics.NewCounterVec(
+			&metrics.CounterOpts{
+				Name:           "crd_validation_ratcheting_demoted_errors_total",
+				Help:           "Number of CRD validation errors demoted to warnings by ratcheting, by the schema rule that produced them.",
+				StabilityLevel: metrics.ALPHA,
+			},
+			[]string{"rule"},
+		),
+		traversalTime: metrics.NewHistogram(
+			&metrics.HistogramOpts{
+				Name:           "crd_validation_ratcheting_tree_traversal_seconds",
+				Help:           "Time taken to traverse the correlated object tree for a single CRD update validated with ratcheting.",
+				Buckets:        metrics.ExponentialBuckets(0.0001, 2, 15),
+				StabilityLevel: metrics.ALPHA,
+			},
+		),
+	}
+	legacyregistry.MustRegister(m.demotedErrors)
+	legacyregistry.MustRegister(m.traversalTime)
+	return m
+}
+
+func (m *ratchetingMetrics) ObserveRatchetedError(rule string) {
+	m.demotedErrors.WithLabelValues(rule).Inc()
+}
+
+func (m *ratchetingMetrics) ObserveTraversalTime(seconds float64) {
+	m.traversalTime.Observe(seconds)
+}
+
+// RatchetedError records a single validation error that was accepted only
+// because ratcheting allowed it, so operators can audit which pre-existing
+// invalid data a request was allowed to keep.
+type RatchetedError struct {
+	// Path is the JSON path of the field the error occurred on.
+	Path string
+	// Rule is the schema validation rule that produced the error, e.g.
+	// "maxLength", "pattern", "enum", "format". Empty if it could not be
+	// classified by ruleNameForError.
+	Rule string
+	// Warning is the ratcheted error re-surfaced as a warning, or nil if the
+	// policy dropped it entirely rather than demoting it.
+	Warning error
+}
+
+// Result wraps the *validate.Result produced by a ValidateUpdate(WithCorrelation)
+// call with the set of errors that were only accepted because of ratcheting,
+// so admission code paths can log which fields were accepted despite being
+// invalid.
+type Result struct {
+	*validate.Result
+	RatchetedErrors []RatchetedError
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"k8s.io/kube-openapi/pkg/validation/errors"
+)
+
+// RatchetingPolicy decides, for a single validation error discovered at a
+// node of a CorrelatedObject tree, whether that error should be ratcheted
+// (i.e. not treated as a hard validation failure), and if so whether it
+// should be kept around as a warning or dropped entirely.
+//
+// Implementations must not mutate correlation; they may call its read-only
+// accessors such as CachedDeepEqual.
+type RatchetingPolicy interface {
+	ShouldRatchet(correlation *CorrelatedObject, err errors.Error) (ratchet bool, asWarning bool)
+}
+
+// DeepEqualRatchetingPolicy is the original ratcheting policy used by
+// RatchetingSchemaValidator before RatchetingPolicy was pluggable: every
+// error found at a node is ratcheted, and kept as a warning, iff the node's
+// value is CachedDeepEqual to its old value. It is the default policy.
+type DeepEqualRatchetingPolicy struct{}
+
+func (DeepEqualRatchetingPolicy) ShouldRatchet(correlation *CorrelatedObject, err errors.Error) (ratchet bool, asWarning bool) {
+	if correlation.CachedDeepEqual() {
+		return true, true
+	}
+	return false, false
+}
+
+// AncestorCorrelatedRatchetingPolicy ratchets an error if the node it
+// occurred on, or the nearest ancestor of that node which is still
+// correlated to an old value, is unchanged from its old value. This mirrors
+// the CEL validator's shouldRatchetError, which ratchets a CEL rule failure
+// if the value the rule ran on, or its nearest correlated ancestor, is
+// unchanged, since a single CEL rule can consider several sibling fields at
+// once and so cannot always be pinned to the exact node that changed.
+//
+// Deliberately uses a raw reflect.DeepEqual of the node's and the ancestor's
+// Value/OldValue (via rawDeepEqual) rather than CachedDeepEqual: CachedDeepEqual on an
+// array/map node also returns false whenever any of that node's own children
+// weren't fully explored during validation, and every child so explored is
+// the exact same *CorrelatedObject the child's own CachedDeepEqual already
+// ran against. That means an ancestor's CachedDeepEqual can never be true
+// when the node's own CachedDeepEqual is false — checking the ancestor with
+// CachedDeepEqual would be unable to find anything DeepEqualRatchetingPolicy
+// didn't already find at the node itself. rawDeepEqual has no such
+// dependency on traversal completeness, so it can still report an ancestor
+// as unchanged even when one of its descendants was left unexplored.
+type AncestorCorrelatedRatchetingPolicy struct{}
+
+func (AncestorCorrelatedRatchetingPolicy) ShouldRatchet(correlation *CorrelatedObject, err errors.Error) (ratchet bool, asWarning bool) {
+	if correlation == nil {
+		return false, false
+	}
+	// Every node in the tree is correlated to an old value, so the nearest
+	// correlated ancestor is the parent.
+	if correlation.rawDeepEqual() || (correlation.parent != nil && correlation.parent.rawDeepEqual()) {
+		return true, true
+	}
+	return false, false
+}
+
+// RuleScopedRatchetingPolicy only ratchets errors produced by one of a
+// configured set of schema validation rules, and never ratchets errors from
+// any other rule — notably structural errors such as required fields or
+// type mismatches — even if the surrounding value is otherwise unchanged.
+// This is stricter than DeepEqualRatchetingPolicy and is meant for operators
+// who want to allow migrating away from, say, an overly permissive pattern
+// or enum, without silently letting previously-accepted structural drift
+// continue to validate.
+//
+// Note that a failed format check (e.g. "date-time", "uuid") cannot be
+// scoped separately from a genuine structural type mismatch: kube-openapi
+// surfaces both as the same InvalidTypeCode, which ruleNameForError
+// classifies as "type" for both. "format" is therefore not a usable Rules
+// entry.
+type RuleScopedRatchetingPolicy struct {
+	// Rules is the set of schema validation rule names (as returned by
+	// ruleNameForError, e.g. "maxLength", "pattern", "enum") eligible for
+	// ratcheting. Errors produced by any other rule, or whose rule could not
+	// be determined, are never ratcheted.
+	Rules map[string]bool
+}
+
+// NewRuleScopedRatchetingPolicy returns a RuleScopedRatchetingPolicy that
+// ratchets the common non-structural rules: maxLength, minLength, pattern
+// and enum.
+func NewRuleScopedRatchetingPolicy() RuleScopedRatchetingPolicy {
+	return RuleScopedRatchetingPolicy{
+		Rules: map[string]bool{
+			"maxLength": true,
+			"minLength": true,
+			"pattern":   true,
+			"enum":      true,
+		},
+	}
+}
+
+func (p RuleScopedRatchetingPolicy) ShouldRatchet(correlation *CorrelatedObject, err errors.Error) (ratchet bool, asWarning bool) {
+	if !p.Rules[ruleNameForError(err)] {
+		return false, false
+	}
+	if correlation.CachedDeepEqual() {
+		return true, true
+	}
+	return false, false
+}
+
+// ruleNameForError classifies err by the schema validation rule that
+// produced it (e.g. "maxLength", "pattern", "enum", "required", "type"), for
+// use by RuleScopedRatchetingPolicy and by the ratcheting metrics/audit
+// trail. Returns "" if the rule could not be determined from err's code.
+func ruleNameForError(err errors.Error) string {
+	switch err.Code() {
+	case errors.TooLongFailCode:
+		return "maxLength"
+	case errors.TooShortFailCode:
+		return "minLength"
+	case errors.PatternFailCode:
+		return "pattern"
+	case errors.EnumFailCode:
+		return "enum"
+	case errors.MaxFailCode:
+		return "maximum"
+	case errors.MinFailCode:
+		return "minimum"
+	case errors.MaxItemsFailCode:
+		return "maxItems"
+	case errors.MinItemsFailCode:
+		return "minItems"
+	case errors.RequiredFailCode:
+		return "required"
+	case errors.InvalidTypeCode:
+		// Also the code for a failed format check (e.g. "date-time", "uuid"):
+		// kube-openapi's format validator reports that failure as
+		// errors.InvalidType too, so it is indistinguishable from a genuine
+		// structural type mismatch by code alone.
+		return "type"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+)
+
+// maxLengthSchema returns an object schema with a single string property "s"
+// whose maxLength is 3, for exercising ratcheting across a recursive
+// property validation rather than only at the schema root.
+func maxLengthSchema() *spec.Schema {
+	maxLength := int64(3)
+	return &spec.Schema{
+		SchemaProps: spec.SchemaProps{
+			Type: spec.StringOrArray{"object"},
+			Properties: map[string]spec.Schema{
+				"s": {
+					SchemaProps: spec.SchemaProps{
+						Type:      spec.StringOrArray{"string"},
+						MaxLength: &maxLength,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidateUpdateRatchetsUnchangedErrorWithAudit(t *testing.T) {
+	schema := maxLengthSchema()
+	value := map[string]interface{}{"s": "toolong"}
+
+	result := NewRatchetingSchemaValidator(schema, nil, "", strfmt.Default).ValidateUpdate(value, value)
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("expected the unchanged maxLength violation to be ratcheted away from Errors, got %v", result.Errors)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("expected the ratcheted maxLength violation to be kept as a warning, got %v", result.Warnings)
+	}
+	if len(result.RatchetedErrors) != 1 {
+		t.Fatalf("expected one audited RatchetedError, got %+v", result.RatchetedErrors)
+	}
+	if rule := result.RatchetedErrors[0].Rule; rule != "maxLength" {
+		t.Fatalf("expected the audited RatchetedError to be classified as maxLength, got %q", rule)
+	}
+	if result.RatchetedErrors[0].Warning == nil {
+		t.Fatalf("expected the audited RatchetedError to carry the demoted warning")
+	}
+	if !strings.Contains(result.RatchetedErrors[0].Path, "s") {
+		t.Fatalf("expected the audited RatchetedError's Path to reference property \"s\", got %q", result.RatchetedErrors[0].Path)
+	}
+}
+
+func TestWithRatchetingCorrelationMatchesValidateUpdateWithCorrelation(t *testing.T) {
+	schema := maxLengthSchema()
+	value := map[string]interface{}{"s": "toolong"}
+
+	// A caller using RatchetingSchemaValidator directly.
+	viaValidator := NewRatchetingSchemaValidator(schema, nil, "", strfmt.Default)
+	fromValidator := viaValidator.ValidateUpdateWithCorrelation(value, value, NewCorrelatedObject(value, value, schema))
+	if len(fromValidator.RatchetedErrors) != 1 {
+		t.Fatalf("expected RatchetingSchemaValidator to ratchet the unchanged maxLength violation, got %+v", fromValidator.RatchetedErrors)
+	}
+
+	// A caller building its own SchemaValidator via raw validate.Option
+	// plumbing, using WithRatchetingCorrelation against a freshly built
+	// CorrelatedObject for the same update, should demote the same error.
+	correlation := NewCorrelatedObject(value, value, schema)
+	sv := validate.NewSchemaValidator(schema, nil, "", strfmt.Default, WithRatchetingCorrelation(correlation, DeepEqualRatchetingPolicy{}))
+	res := sv.Validate(value)
+
+	if len(res.Errors) != 0 {
+		t.Fatalf("expected WithRatchetingCorrelation to ratchet away the unchanged maxLength violation, got errors %v", res.Errors)
+	}
+	if len(res.Warnings) != 1 {
+		t.Fatalf("expected WithRatchetingCorrelation to keep the ratcheted violation as a warning, got %v", res.Warnings)
+	}
+}
+
+func TestCachedDeepEqualContentHasherFastPath(t *testing.T) {
+	// A hasher that always returns the same hash makes CachedDeepEqual trust
+	// it completely, even for two Values that are not actually
+	// reflect.DeepEqual, proving the hasher genuinely short-circuits the walk
+	// rather than just being consulted alongside it.
+	constantHash := func(v interface{}) uint64 { return 1 }
+
+	correlation := NewCorrelatedObject("new-value", "different-old-value", nil, WithContentHasher(constantHash))
+	if !correlation.CachedDeepEqual() {
+		t.Fatalf("expected CachedDeepEqual to trust the content hasher and report equal despite differing Values")
+	}
+}
+
+func TestCorrelateSetElementDedup(t *testing.T) {
+	old := []interface{}{"a", "b"}
+	r := &CorrelatedObject{}
+
+	if got := r.correlateSetElement(old, "a"); got != "a" {
+		t.Fatalf("expected new \"a\" to correlate to old \"a\", got %v", got)
+	}
+
+	// A second new "a" must not correlate to the same old "a" again: it was
+	// already consumed by the first match above.
+	if got := r.correlateSetElement(old, "a"); got != nil {
+		t.Fatalf("expected second new \"a\" to not correlate to the already-consumed old \"a\", got %v", got)
+	}
+
+	if got := r.correlateSetElement(old, "b"); got != "b" {
+		t.Fatalf("expected new \"b\" to still correlate to old \"b\", got %v", got)
+	}
+}
+
+func TestAncestorCorrelatedRatchetingPolicy(t *testing.T) {
+	value := map[string]interface{}{"a": "x", "b": "y"}
+	node := &CorrelatedObject{
+		Value:    value,
+		OldValue: value,
+		// Simulate "b" having gone unexplored during validation (e.g. the
+		// validator short-circuited before reaching it). node is otherwise
+		// byte-for-byte the same value as its old value.
+		children: map[interface{}]*CorrelatedObject{
+			"a": {Value: "x", OldValue: "x"},
+		},
+	}
+
+	if node.CachedDeepEqual() {
+		t.Fatalf("expected CachedDeepEqual to be false when a child went unexplored")
+	}
+
+	if ratchet, _ := (DeepEqualRatchetingPolicy{}).ShouldRatchet(node, nil); ratchet {
+		t.Fatalf("expected DeepEqualRatchetingPolicy not to ratchet when CachedDeepEqual is false")
+	}
+
+	ratchet, asWarning := (AncestorCorrelatedRatchetingPolicy{}).ShouldRatchet(node, nil)
+	if !ratchet || !asWarning {
+		t.Fatalf("expected AncestorCorrelatedRatchetingPolicy to ratchet via rawDeepEqual, got ratchet=%v asWarning=%v", ratchet, asWarning)
+	}
+}